@@ -0,0 +1,34 @@
+package v1beta1
+
+// Repository defines the helm repository to add for the extensions.
+type Repository struct {
+	// Name is the repository name to reference it later
+	Name string `json:"name,omitempty"`
+	// URL is the url of the repository, or `oci://host/path` for an OCI
+	// registry
+	URL string `json:"url,omitempty"`
+	// Username is an optional username for authenticating against the
+	// repository
+	Username string `json:"username,omitempty"`
+	// Password is an optional password for authenticating against the
+	// repository
+	Password string `json:"password,omitempty"`
+	// CAFile is an optional path to a CA bundle used to verify the
+	// repository's TLS certificate
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile is an optional path to a client certificate used to
+	// authenticate against the repository
+	CertFile string `json:"certFile,omitempty"`
+	// KeyFile is an optional path to the client certificate's private key
+	KeyFile string `json:"keyFile,omitempty"`
+	// Verify enables provenance verification of charts downloaded from this
+	// repository before they are installed: a cosign signature check for
+	// OCI charts, a PGP keyring check otherwise.
+	Verify bool `json:"verify,omitempty"`
+	// Keyring is the path to the PGP keyring used to verify charts when
+	// Verify is set. Defaults to the cluster-wide helm keyring when empty.
+	Keyring string `json:"keyring,omitempty"`
+	// CosignPublicKey is the path to the cosign public key used to verify
+	// OCI chart artifacts when Verify is set.
+	CosignPublicKey string `json:"cosignPublicKey,omitempty"`
+}
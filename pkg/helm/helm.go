@@ -1,32 +1,90 @@
 package helm
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/k0sproject/k0s/internal/util"
 	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/v1beta1"
 	"github.com/k0sproject/k0s/pkg/constant"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/go-multierror"
+	"github.com/sigstore/cosign/pkg/cosign"
 	"gopkg.in/yaml.v2"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/downloader"
 	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
 	"helm.sh/helm/v3/pkg/repo"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 )
 
+// registryConfigFileName is the credentials file persisted under the helm
+// cache dir by RegistryLogin/RegistryLogout.
+const registryConfigFileName = "registry.json"
+
+// verifyConfigFileName stores per-repository provenance verification
+// settings, since helm's native repo.File format has no room for them.
+const verifyConfigFileName = "verify.yaml"
+
+// ociRepoFileName tracks the oci:// repositories added via AddRepository,
+// since they have no entry in hc.repoFile: their state lives in the OCI
+// registry credentials file instead.
+const ociRepoFileName = "oci-repositories.yaml"
+
+// ChartVerifier verifies the provenance of an OCI chart artifact before it is
+// installed. The default implementation checks a cosign signature, but it
+// can be swapped out via Commands.SetChartVerifier.
+type ChartVerifier interface {
+	Verify(ctx context.Context, ref string, publicKey string) error
+}
+
+// cosignChartVerifier is the default ChartVerifier, backed by cosign
+// signature verification of the OCI artifact referenced by ref.
+type cosignChartVerifier struct{}
+
+func (cosignChartVerifier) Verify(ctx context.Context, ref string, publicKey string) error {
+	if publicKey == "" {
+		return fmt.Errorf("cosign verification requires a public key")
+	}
+	verifier, err := cosign.LoadPublicKey(ctx, publicKey)
+	if err != nil {
+		return fmt.Errorf("can't load cosign public key `%s`: %v", publicKey, err)
+	}
+	signedRef, err := name.ParseReference(ref)
+	if err != nil {
+		return fmt.Errorf("can't parse chart reference `%s`: %v", ref, err)
+	}
+	if _, _, err := cosign.VerifyImageSignatures(ctx, signedRef, &cosign.CheckOpts{SigVerifier: verifier}); err != nil {
+		return fmt.Errorf("cosign verification of `%s` failed: %v", ref, err)
+	}
+	return nil
+}
+
 // Commands run different helm command in the same way as CLI tool
 type Commands struct {
-	repoFile     string
-	helmCacheDir string
-	kubeConfig   string
+	repoFile      string
+	helmCacheDir  string
+	kubeConfig    string
+	keyring       string
+	chartVerifier ChartVerifier
+	// actionCfgFactory overrides how getActionCfg builds an
+	// action.Configuration. Nil in production; tests set it to plug in an
+	// in-memory release store and a fake kube client instead of a real
+	// cluster.
+	actionCfgFactory func(namespace string) (*action.Configuration, error)
 }
 
 var getters = getter.Providers{
@@ -39,13 +97,25 @@ var getters = getter.Providers{
 // NewCommands builds new Commands instance with default values
 func NewCommands(k0sVars constant.CfgVars) *Commands {
 	return &Commands{
-		repoFile:     k0sVars.HelmRepositoryConfig,
-		helmCacheDir: k0sVars.HelmRepositoryCache,
-		kubeConfig:   k0sVars.AdminKubeConfigPath,
+		repoFile:      k0sVars.HelmRepositoryConfig,
+		helmCacheDir:  k0sVars.HelmRepositoryCache,
+		kubeConfig:    k0sVars.AdminKubeConfigPath,
+		keyring:       k0sVars.HelmKeyring,
+		chartVerifier: cosignChartVerifier{},
 	}
 }
 
+// SetChartVerifier overrides the ChartVerifier used to check cosign
+// signatures on OCI chart artifacts. Intended for tests and for swapping in
+// alternative signing schemes.
+func (hc *Commands) SetChartVerifier(v ChartVerifier) {
+	hc.chartVerifier = v
+}
+
 func (hc *Commands) getActionCfg(namespace string) (*action.Configuration, error) {
+	if hc.actionCfgFactory != nil {
+		return hc.actionCfgFactory(namespace)
+	}
 	insecure := false
 	impersonateGroup := []string{}
 	cfg := &genericclioptions.ConfigFlags{
@@ -63,19 +133,248 @@ func (hc *Commands) getActionCfg(namespace string) (*action.Configuration, error
 	return actionConfig, nil
 }
 
-func (hc *Commands) AddRepository(repoCfg k0sv1beta1.Repository) error {
-	err := util.InitDirectory(filepath.Dir(hc.repoFile), constant.DataDirMode)
-	if err != nil && !os.IsExist(err) {
-		return fmt.Errorf("can't add repository to %s: %v", hc.repoFile, err)
+// registryConfigFile returns the path to the OCI registry credentials file
+// persisted by RegistryLogin/RegistryLogout.
+func (hc *Commands) registryConfigFile() string {
+	return filepath.Join(hc.helmCacheDir, registryConfigFileName)
+}
+
+// registryClient builds an OCI registry client backed by the credentials
+// stored by RegistryLogin.
+func (hc *Commands) registryClient() (*registry.Client, error) {
+	if err := util.InitDirectory(hc.helmCacheDir, constant.DataDirMode); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("can't create registry client: %v", err)
+	}
+	return registry.NewClient(
+		registry.ClientOptWriter(os.Stdout),
+		registry.ClientOptCredentialsFile(hc.registryConfigFile()),
+	)
+}
+
+// RegistryLogin stores credentials for an OCI registry so that subsequent
+// `oci://` chart references against host are authenticated automatically.
+func (hc *Commands) RegistryLogin(host string, user string, pass string, insecure bool) error {
+	rc, err := hc.registryClient()
+	if err != nil {
+		return fmt.Errorf("can't log in to registry `%s`: %v", host, err)
 	}
+	if err := rc.Login(host,
+		registry.LoginOptBasicAuth(user, pass),
+		registry.LoginOptInsecure(insecure),
+	); err != nil {
+		return fmt.Errorf("can't log in to registry `%s`: %v", host, err)
+	}
+	return nil
+}
+
+// RegistryLogout removes stored credentials for an OCI registry.
+func (hc *Commands) RegistryLogout(host string) error {
+	rc, err := hc.registryClient()
+	if err != nil {
+		return fmt.Errorf("can't log out of registry `%s`: %v", host, err)
+	}
+	if err := rc.Logout(host); err != nil {
+		return fmt.Errorf("can't log out of registry `%s`: %v", host, err)
+	}
+	return nil
+}
 
+// loadRepoFile reads and parses hc.repoFile, returning an empty repo.File if
+// it does not exist yet.
+func (hc *Commands) loadRepoFile() (*repo.File, error) {
 	b, err := ioutil.ReadFile(hc.repoFile)
 	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f := &repo.File{}
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// findRepoEntry looks up the repo.Entry a chart reference should be
+// downloaded with. It first tries to match the repo prefix of a
+// "reponame/chartname" reference against the configured repositories, and
+// falls back to matching repoURL against a repository's URL so that
+// credentials already stored for that URL get reused.
+func (hc *Commands) findRepoEntry(ref string, repoURL string) *repo.Entry {
+	f, err := hc.loadRepoFile()
+	if err != nil {
+		return nil
+	}
+	if idx := strings.Index(ref, "/"); idx > 0 {
+		repoName := ref[:idx]
+		for _, e := range f.Repositories {
+			if e.Name == repoName {
+				return e
+			}
+		}
+	}
+	if repoURL != "" {
+		for _, e := range f.Repositories {
+			if e.URL == repoURL {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// repoVerifyConfig holds the provenance verification settings of a single
+// repository, keyed by repo name for classic repos and by registry host for
+// OCI ones.
+type repoVerifyConfig struct {
+	Verify          bool   `yaml:"verify"`
+	Keyring         string `yaml:"keyring"`
+	CosignPublicKey string `yaml:"cosignPublicKey"`
+}
+
+func (hc *Commands) verifyConfigFile() string {
+	return filepath.Join(filepath.Dir(hc.repoFile), verifyConfigFileName)
+}
+
+func (hc *Commands) loadVerifyConfig() (map[string]repoVerifyConfig, error) {
+	cfg := map[string]repoVerifyConfig{}
+	b, err := ioutil.ReadFile(hc.verifyConfigFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// setVerifyConfig persists the verification settings for key, which is a
+// repo name for classic repos or a registry host for OCI ones.
+func (hc *Commands) setVerifyConfig(key string, vcfg repoVerifyConfig) error {
+	cfg, err := hc.loadVerifyConfig()
+	if err != nil {
+		return fmt.Errorf("can't persist verification settings: %v", err)
+	}
+	cfg[key] = vcfg
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("can't persist verification settings: %v", err)
+	}
+	if err := ioutil.WriteFile(hc.verifyConfigFile(), b, 0644); err != nil {
+		return fmt.Errorf("can't persist verification settings: %v", err)
+	}
+	return nil
+}
+
+// findVerifyConfig looks up the verification settings for key, which is a
+// repo name for classic repos or a registry host for OCI ones.
+func (hc *Commands) findVerifyConfig(key string) repoVerifyConfig {
+	cfg, err := hc.loadVerifyConfig()
+	if err != nil {
+		return repoVerifyConfig{}
+	}
+	return cfg[key]
+}
+
+// ociRepoEntry records enough about an oci:// repository added via
+// AddRepository to list and remove it again later.
+type ociRepoEntry struct {
+	Name string `yaml:"name"`
+	Host string `yaml:"host"`
+}
+
+func (hc *Commands) ociRepoFile() string {
+	return filepath.Join(filepath.Dir(hc.repoFile), ociRepoFileName)
+}
+
+func (hc *Commands) loadOCIRepos() (map[string]ociRepoEntry, error) {
+	entries := map[string]ociRepoEntry{}
+	b, err := ioutil.ReadFile(hc.ociRepoFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// saveOCIRepo records that name was added as an oci:// repository on host,
+// so ListRepositories and RemoveRepository can find it again later.
+func (hc *Commands) saveOCIRepo(name string, host string) error {
+	entries, err := hc.loadOCIRepos()
+	if err != nil {
+		return fmt.Errorf("can't persist OCI repository `%s`: %v", name, err)
+	}
+	entries[name] = ociRepoEntry{Name: name, Host: host}
+	b, err := yaml.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("can't persist OCI repository `%s`: %v", name, err)
+	}
+	if err := ioutil.WriteFile(hc.ociRepoFile(), b, 0644); err != nil {
+		return fmt.Errorf("can't persist OCI repository `%s`: %v", name, err)
+	}
+	return nil
+}
+
+// removeOCIRepo forgets name, returning the entry that was removed, or nil
+// if name was not a known oci:// repository.
+func (hc *Commands) removeOCIRepo(name string) (*ociRepoEntry, error) {
+	entries, err := hc.loadOCIRepos()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := entries[name]
+	if !ok {
+		return nil, nil
+	}
+	delete(entries, name)
+	b, err := yaml.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(hc.ociRepoFile(), b, 0644); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ociRegistryHost extracts the registry hostname from s, which may be an
+// oci://host[/path] repository URL or an already-unprefixed host[/path]
+// chart reference. Any path component is discarded, since the registry
+// client, credential store and verify config are all keyed by host alone.
+func ociRegistryHost(s string) string {
+	s = strings.TrimPrefix(s, fmt.Sprintf("%s://", registry.OCIScheme))
+	return strings.SplitN(s, "/", 2)[0]
+}
+
+func (hc *Commands) AddRepository(repoCfg k0sv1beta1.Repository) error {
+	if registry.IsOCI(repoCfg.URL) {
+		host := ociRegistryHost(repoCfg.URL)
+		if err := hc.RegistryLogin(host, repoCfg.Username, repoCfg.Password, false); err != nil {
+			return err
+		}
+		if err := hc.saveOCIRepo(repoCfg.Name, host); err != nil {
+			return err
+		}
+		return hc.setVerifyConfig(host, repoVerifyConfig{
+			Verify:          repoCfg.Verify,
+			Keyring:         repoCfg.Keyring,
+			CosignPublicKey: repoCfg.CosignPublicKey,
+		})
+	}
+
+	err := util.InitDirectory(filepath.Dir(hc.repoFile), constant.DataDirMode)
+	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("can't add repository to %s: %v", hc.repoFile, err)
 	}
 
-	var f repo.File
-	if err := yaml.Unmarshal(b, &f); err != nil {
+	f, err := hc.loadRepoFile()
+	if err != nil {
 		return fmt.Errorf("can't add repository to %s: %v", hc.repoFile, err)
 	}
 
@@ -105,9 +404,156 @@ func (hc *Commands) AddRepository(repoCfg k0sv1beta1.Repository) error {
 		return fmt.Errorf("can't add repository to %s: %v", hc.repoFile, err)
 	}
 
+	return hc.setVerifyConfig(repoCfg.Name, repoVerifyConfig{
+		Verify:          repoCfg.Verify,
+		Keyring:         repoCfg.Keyring,
+		CosignPublicKey: repoCfg.CosignPublicKey,
+	})
+}
+
+// RemoveRepository removes name from hc.repoFile, or, for an oci://
+// repository added via AddRepository's OCI branch, logs it out of the
+// registry. It deletes the classic repository's cached index and charts
+// list, if any.
+func (hc *Commands) RemoveRepository(name string) error {
+	f, err := hc.loadRepoFile()
+	if err != nil {
+		return fmt.Errorf("can't remove repository `%s`: %v", name, err)
+	}
+
+	if f.Remove(name) {
+		if err := f.WriteFile(hc.repoFile, 0644); err != nil {
+			return fmt.Errorf("can't remove repository `%s`: %v", name, err)
+		}
+
+		for _, cacheFile := range []string{
+			filepath.Join(hc.helmCacheDir, fmt.Sprintf("%s-index.yaml", name)),
+			filepath.Join(hc.helmCacheDir, fmt.Sprintf("%s-charts.txt", name)),
+		} {
+			if err := os.Remove(cacheFile); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("can't remove repository `%s`: %v", name, err)
+			}
+		}
+		return nil
+	}
+
+	ociEntry, err := hc.removeOCIRepo(name)
+	if err != nil {
+		return fmt.Errorf("can't remove repository `%s`: %v", name, err)
+	}
+	if ociEntry == nil {
+		return fmt.Errorf("can't remove repository `%s`: no such repository", name)
+	}
+	if err := hc.RegistryLogout(ociEntry.Host); err != nil {
+		return fmt.Errorf("can't remove repository `%s`: %v", name, err)
+	}
 	return nil
 }
 
+// ListRepositories returns the repositories currently configured in
+// hc.repoFile or added as oci:// repositories, merged with their
+// provenance verification settings.
+func (hc *Commands) ListRepositories() ([]k0sv1beta1.Repository, error) {
+	f, err := hc.loadRepoFile()
+	if err != nil {
+		return nil, fmt.Errorf("can't list repositories: %v", err)
+	}
+	ociEntries, err := hc.loadOCIRepos()
+	if err != nil {
+		return nil, fmt.Errorf("can't list repositories: %v", err)
+	}
+
+	repos := make([]k0sv1beta1.Repository, 0, len(f.Repositories)+len(ociEntries))
+	for _, e := range f.Repositories {
+		vcfg := hc.findVerifyConfig(e.Name)
+		repos = append(repos, k0sv1beta1.Repository{
+			Name:            e.Name,
+			URL:             e.URL,
+			Username:        e.Username,
+			Password:        e.Password,
+			CertFile:        e.CertFile,
+			KeyFile:         e.KeyFile,
+			CAFile:          e.CAFile,
+			Verify:          vcfg.Verify,
+			Keyring:         vcfg.Keyring,
+			CosignPublicKey: vcfg.CosignPublicKey,
+		})
+	}
+	for _, e := range ociEntries {
+		vcfg := hc.findVerifyConfig(e.Host)
+		repos = append(repos, k0sv1beta1.Repository{
+			Name:            e.Name,
+			URL:             fmt.Sprintf("%s://%s", registry.OCIScheme, e.Host),
+			Verify:          vcfg.Verify,
+			Keyring:         vcfg.Keyring,
+			CosignPublicKey: vcfg.CosignPublicKey,
+		})
+	}
+	return repos, nil
+}
+
+// updateRepositoriesConcurrency bounds how many repository indexes
+// UpdateRepositories refreshes at once.
+const updateRepositoriesConcurrency = 5
+
+// UpdateRepositories refreshes the cached index of the named repositories,
+// or of all configured repositories when names is empty. Refreshes run
+// concurrently, bounded by updateRepositoriesConcurrency, and a failure for
+// one repository does not stop the others; all errors are returned together.
+func (hc *Commands) UpdateRepositories(names ...string) error {
+	f, err := hc.loadRepoFile()
+	if err != nil {
+		return fmt.Errorf("can't update repositories: %v", err)
+	}
+
+	entries := f.Repositories
+	if len(names) > 0 {
+		wanted := make(map[string]bool, len(names))
+		for _, n := range names {
+			wanted[n] = true
+		}
+		entries = entries[:0]
+		for _, e := range f.Repositories {
+			if wanted[e.Name] {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, updateRepositoriesConcurrency)
+		mu   sync.Mutex
+		errs *multierror.Error
+	)
+	for _, e := range entries {
+		e := e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			r, err := repo.NewChartRepository(e, getters)
+			if err != nil {
+				mu.Lock()
+				errs = multierror.Append(errs, fmt.Errorf("can't update repository `%s`: %v", e.Name, err))
+				mu.Unlock()
+				return
+			}
+			r.CachePath = hc.helmCacheDir
+			if _, err := r.DownloadIndexFile(); err != nil {
+				mu.Lock()
+				errs = multierror.Append(errs, fmt.Errorf("can't update repository `%s`: %v", e.Name, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errs.ErrorOrNil()
+}
+
 func (hc *Commands) downloadDependencies(chart *chart.Chart, chartPath string) error {
 	if chart.Metadata.Dependencies == nil {
 		return nil
@@ -129,9 +575,13 @@ func (hc *Commands) downloadDependencies(chart *chart.Chart, chartPath string) e
 	return nil
 }
 
-func (hc *Commands) locateChart(name string, version string) (string, error) {
+func (hc *Commands) locateChart(name string, version string, repoURL string) (string, error) {
 	name = strings.TrimSpace(name)
 
+	if registry.IsOCI(name) {
+		return hc.locateOCIChart(name, version)
+	}
+
 	if _, err := os.Stat(name); err == nil {
 		abs, err := filepath.Abs(name)
 		if err != nil {
@@ -143,28 +593,52 @@ func (hc *Commands) locateChart(name string, version string) (string, error) {
 		return name, fmt.Errorf("can't locate chart: path not found: %s", name)
 	}
 
+	entry := hc.findRepoEntry(name, repoURL)
+
+	// The verify-config key is the configured repository name, which must be
+	// resolved before name is possibly rewritten to a resolved chart URL
+	// below.
+	verifyKey := ""
+	if entry != nil {
+		verifyKey = entry.Name
+	} else if idx := strings.Index(name, "/"); idx > 0 {
+		verifyKey = name[:idx]
+	}
+
 	dl := downloader.ChartDownloader{
-		Out:     os.Stdout,
-		Getters: getters,
-		Options: []getter.Option{
-			//getter.WithBasicAuth(c.Username, c.Password),
-			//getter.WithTLSClientConfig(c.CertFile, c.KeyFile, c.CaFile),
-			//getter.WithInsecureSkipVerifyTLS(c.InsecureSkipTLSverify),
-		},
+		Out:              os.Stdout,
+		Getters:          getters,
 		RepositoryConfig: hc.repoFile,
 		RepositoryCache:  hc.helmCacheDir,
 	}
-	//if c.Verify {
-	//	dl.Verify = downloader.VerifyAlways
-	//}
-	//if c.RepoURL != "" {
-	//	chartURL, err := repo.FindChartInAuthAndTLSRepoURL(c.RepoURL, c.Username, c.Password, name, version,
-	//		c.CertFile, c.KeyFile, c.CaFile, c.InsecureSkipTLSverify, getter.All(settings))
-	//	if err != nil {
-	//		return "", err
-	//	}
-	//	name = chartURL
-	//}
+
+	if repoURL != "" {
+		username, password, certFile, keyFile, caFile, insecureSkipTLSverify := entryCredentials(entry)
+		chartURL, err := repo.FindChartInAuthAndTLSRepoURL(repoURL, username, password, name, version,
+			certFile, keyFile, caFile, insecureSkipTLSverify, getters)
+		if err != nil {
+			return "", fmt.Errorf("can't locate chart `%s-%s`: %v", name, version, err)
+		}
+		name = chartURL
+		dl.Options = append(dl.Options, getter.WithBasicAuth(username, password), getter.WithTLSClientConfig(certFile, keyFile, caFile), getter.WithInsecureSkipVerifyTLS(insecureSkipTLSverify))
+	} else if entry != nil {
+		dl.Options = append(dl.Options,
+			getter.WithBasicAuth(entry.Username, entry.Password),
+			getter.WithTLSClientConfig(entry.CertFile, entry.KeyFile, entry.CAFile),
+			getter.WithInsecureSkipVerifyTLS(entry.InsecureSkipTLSverify),
+		)
+	}
+
+	if verifyKey != "" {
+		if vcfg := hc.findVerifyConfig(verifyKey); vcfg.Verify {
+			keyring := vcfg.Keyring
+			if keyring == "" {
+				keyring = hc.keyring
+			}
+			dl.Verify = downloader.VerifyAlways
+			dl.Keyring = keyring
+		}
+	}
 
 	if err := util.InitDirectory(hc.helmCacheDir, constant.DataDirMode); err != nil {
 		return "", fmt.Errorf("can't locate chart `%s-%s`: %v", name, version, err)
@@ -188,6 +662,57 @@ func (hc *Commands) locateChart(name string, version string) (string, error) {
 	return filename, fmt.Errorf("failed to download %q%s (hint: running `helm repo update` may help)", name, atVersion)
 }
 
+// ociChartFilename returns the cache filename a chart pulled from
+// unversionedRef (host/path, without the oci:// scheme or a :version tag) is
+// stored under.
+func ociChartFilename(unversionedRef, version string) string {
+	return fmt.Sprintf("%s-%s.tgz", path.Base(unversionedRef), version)
+}
+
+// locateOCIChart pulls a chart referenced as oci://host/path[:version] using
+// the registry client into the helm cache dir and returns the path to the
+// downloaded tarball.
+func (hc *Commands) locateOCIChart(ref string, version string) (string, error) {
+	rc, err := hc.registryClient()
+	if err != nil {
+		return "", fmt.Errorf("can't locate chart `%s`: %v", ref, err)
+	}
+
+	unversionedRef := strings.TrimPrefix(ref, fmt.Sprintf("%s://", registry.OCIScheme))
+	pullRef := unversionedRef
+	if version != "" {
+		pullRef = fmt.Sprintf("%s:%s", unversionedRef, version)
+	}
+
+	result, err := rc.Pull(pullRef)
+	if err != nil {
+		return "", fmt.Errorf("can't locate chart `%s-%s`: %v", ref, version, err)
+	}
+
+	host := ociRegistryHost(pullRef)
+	if vcfg := hc.findVerifyConfig(host); vcfg.Verify {
+		if err := hc.chartVerifier.Verify(context.Background(), pullRef, vcfg.CosignPublicKey); err != nil {
+			return "", fmt.Errorf("can't locate chart `%s-%s`: %v", ref, version, err)
+		}
+	}
+
+	filename := filepath.Join(hc.helmCacheDir, ociChartFilename(unversionedRef, version))
+	if err := ioutil.WriteFile(filename, result.Chart.Data, 0644); err != nil {
+		return "", fmt.Errorf("can't locate chart `%s-%s`: %v", ref, version, err)
+	}
+	return filepath.Abs(filename)
+}
+
+// entryCredentials extracts the auth/TLS material from a repo.Entry, or
+// returns the zero values when entry is nil so callers can fall back to
+// anonymous access.
+func entryCredentials(entry *repo.Entry) (username, password, certFile, keyFile, caFile string, insecureSkipTLSverify bool) {
+	if entry == nil {
+		return "", "", "", "", "", false
+	}
+	return entry.Username, entry.Password, entry.CertFile, entry.KeyFile, entry.CAFile, entry.InsecureSkipTLSverify
+}
+
 func (hc *Commands) isInstallable(chart *chart.Chart) bool {
 	if chart.Metadata.Type != "" && chart.Metadata.Type != "application" {
 		return false
@@ -195,14 +720,25 @@ func (hc *Commands) isInstallable(chart *chart.Chart) bool {
 	return true
 }
 
-func (hc *Commands) InstallChart(chartName string, version string, namespace string, values map[string]interface{}) (*release.Release, error) {
+// InstallChart installs chartName into namespace. When repoURL is set, the
+// chart is fetched directly from that URL without requiring a repository to
+// be added via AddRepository first; matching credentials from an already
+// added repository with the same URL are reused automatically.
+func (hc *Commands) InstallChart(chartName string, version string, namespace string, values map[string]interface{}, repoURL string) (*release.Release, error) {
 	cfg, err := hc.getActionCfg(namespace)
 	if err != nil {
 		return nil, fmt.Errorf("can't create action configuration: %v", err)
 	}
 	install := action.NewInstall(cfg)
 	install.CreateNamespace = true
-	chartDir, err := hc.locateChart(chartName, version)
+	if registry.IsOCI(chartName) {
+		rc, err := hc.registryClient()
+		if err != nil {
+			return nil, fmt.Errorf("can't create registry client: %v", err)
+		}
+		install.SetRegistryClient(rc)
+	}
+	chartDir, err := hc.locateChart(chartName, version, repoURL)
 	if err != nil {
 		return nil, err
 	}
@@ -238,15 +774,26 @@ func (hc *Commands) InstallChart(chartName string, version string, namespace str
 	return release, nil
 }
 
-func (hc *Commands) UpgradeChart(chartName string, version string, releaseName string, namespace string, values map[string]interface{}) (*release.Release, error) {
+// UpgradeChart upgrades releaseName to chartName/version. When repoURL is
+// set, the chart is fetched directly from that URL without requiring a
+// repository to be added via AddRepository first; matching credentials from
+// an already added repository with the same URL are reused automatically.
+func (hc *Commands) UpgradeChart(chartName string, version string, releaseName string, namespace string, values map[string]interface{}, repoURL string) (*release.Release, error) {
 	cfg, err := hc.getActionCfg(namespace)
 	if err != nil {
 		return nil, fmt.Errorf("can't create action configuration: %v", err)
 	}
 	upgrade := action.NewUpgrade(cfg)
 	upgrade.Namespace = namespace
+	if registry.IsOCI(chartName) {
+		rc, err := hc.registryClient()
+		if err != nil {
+			return nil, fmt.Errorf("can't create registry client: %v", err)
+		}
+		upgrade.SetRegistryClient(rc)
+	}
 
-	chartDir, err := hc.locateChart(chartName, version)
+	chartDir, err := hc.locateChart(chartName, version, repoURL)
 	if err != nil {
 		return nil, err
 	}
@@ -300,3 +847,250 @@ func (hc *Commands) UninstallRelease(releaseName string, namespace string) error
 	}
 	return nil
 }
+
+// RollbackOptions controls the behavior of RollbackRelease.
+type RollbackOptions struct {
+	Force         bool
+	Recreate      bool
+	CleanupOnFail bool
+	Wait          bool
+	Timeout       time.Duration
+}
+
+// RollbackRelease rolls back name to revision, or to the previous revision
+// when revision is 0.
+func (hc *Commands) RollbackRelease(name string, namespace string, revision int, opts RollbackOptions) error {
+	cfg, err := hc.getActionCfg(namespace)
+	if err != nil {
+		return fmt.Errorf("can't create action configuration: %v", err)
+	}
+	rollback := action.NewRollback(cfg)
+	rollback.Version = revision
+	rollback.Force = opts.Force
+	rollback.Recreate = opts.Recreate
+	rollback.CleanupOnFail = opts.CleanupOnFail
+	rollback.Wait = opts.Wait
+	rollback.Timeout = opts.Timeout
+	if err := rollback.Run(name); err != nil {
+		return fmt.Errorf("can't rollback release `%s`: %v", name, err)
+	}
+	return nil
+}
+
+// ReleaseHistory returns up to max revisions of name, newest first, or all
+// of them when max is not positive.
+func (hc *Commands) ReleaseHistory(name string, namespace string, max int) ([]*release.Release, error) {
+	cfg, err := hc.getActionCfg(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("can't create action configuration: %v", err)
+	}
+	history := action.NewHistory(cfg)
+	history.Max = max
+	releases, err := history.Run(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't get history of release `%s`: %v", name, err)
+	}
+	// History.Run returns every stored revision in storage order.
+	releaseutil.Reverse(releases, releaseutil.SortByRevision)
+	if max > 0 && len(releases) > max {
+		releases = releases[:max]
+	}
+	return releases, nil
+}
+
+// GetReleaseValues returns the user-supplied values of name, or the computed
+// values (including chart defaults) when allValues is set.
+func (hc *Commands) GetReleaseValues(name string, namespace string, allValues bool) (map[string]interface{}, error) {
+	cfg, err := hc.getActionCfg(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("can't create action configuration: %v", err)
+	}
+	getValues := action.NewGetValues(cfg)
+	getValues.AllValues = allValues
+	values, err := getValues.Run(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't get values of release `%s`: %v", name, err)
+	}
+	return values, nil
+}
+
+// ReleaseStatus returns the current status of name.
+func (hc *Commands) ReleaseStatus(name string, namespace string) (*release.Release, error) {
+	cfg, err := hc.getActionCfg(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("can't create action configuration: %v", err)
+	}
+	status := action.NewStatus(cfg)
+	rel, err := status.Run(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't get status of release `%s`: %v", name, err)
+	}
+	return rel, nil
+}
+
+// TestRelease runs the test hooks of name and returns its resulting release.
+func (hc *Commands) TestRelease(name string, namespace string, timeout time.Duration) (*release.Release, error) {
+	cfg, err := hc.getActionCfg(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("can't create action configuration: %v", err)
+	}
+	test := action.NewReleaseTesting(cfg)
+	test.Timeout = timeout
+	rel, err := test.Run(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't test release `%s`: %v", name, err)
+	}
+	return rel, nil
+}
+
+// UpgradeOptions controls the install/upgrade behavior of InstallOrUpgrade.
+type UpgradeOptions struct {
+	Atomic        bool
+	Wait          bool
+	Timeout       time.Duration
+	Force         bool
+	ResetValues   bool
+	ReuseValues   bool
+	DryRun        bool
+	MaxHistory    int
+	CleanupOnFail bool
+}
+
+// waitForRelease blocks until the workloads of rel are ready, using the same
+// kube client the release was installed/upgraded with.
+func (hc *Commands) waitForRelease(cfg *action.Configuration, rel *release.Release, timeout time.Duration) error {
+	resources, err := cfg.KubeClient.Build(strings.NewReader(rel.Manifest), false)
+	if err != nil {
+		return fmt.Errorf("can't build resources for release `%s`: %v", rel.Name, err)
+	}
+	if err := cfg.KubeClient.WaitForResources(timeout, resources); err != nil {
+		return fmt.Errorf("release `%s` did not become ready: %v", rel.Name, err)
+	}
+	return nil
+}
+
+// InstallOrUpgrade installs releaseName into namespace if it does not exist
+// yet, or upgrades it otherwise, with a deterministic release name instead of
+// the generated names InstallChart produces. When opts.Wait is set it blocks
+// until the release's workloads are ready. When opts.Atomic is set, a failed
+// install is uninstalled and a failed upgrade is rolled back, whether the
+// failure came from the install/upgrade itself or from the subsequent wait.
+func (hc *Commands) InstallOrUpgrade(chartName string, version string, releaseName string, namespace string, values map[string]interface{}, opts UpgradeOptions) (*release.Release, error) {
+	cfg, err := hc.getActionCfg(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("can't create action configuration: %v", err)
+	}
+
+	releases, err := hc.ListReleases(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("can't list releases in namespace `%s`: %v", namespace, err)
+	}
+	exists := false
+	for _, r := range releases {
+		if r.Name == releaseName {
+			exists = true
+			break
+		}
+	}
+
+	chartDir, err := hc.locateChart(chartName, version, "")
+	if err != nil {
+		return nil, err
+	}
+	chrt, err := loader.Load(chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't load chart `%s`: %v", chartDir, err)
+	}
+	if !hc.isInstallable(chrt) {
+		return nil, fmt.Errorf("chart with type `%s` is not installable", chrt.Metadata.Type)
+	}
+	if err := hc.downloadDependencies(chrt, chartDir); err != nil {
+		return nil, err
+	}
+	chrt, err = loader.Load(chartDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't reload chart `%s`: %v", chartDir, err)
+	}
+
+	var rc *registry.Client
+	if registry.IsOCI(chartName) {
+		rc, err = hc.registryClient()
+		if err != nil {
+			return nil, fmt.Errorf("can't create registry client: %v", err)
+		}
+	}
+
+	var rel *release.Release
+	if !exists {
+		install := action.NewInstall(cfg)
+		install.CreateNamespace = true
+		install.Namespace = namespace
+		install.ReleaseName = releaseName
+		install.Atomic = false
+		install.Wait = false
+		install.Timeout = opts.Timeout
+		install.DryRun = opts.DryRun
+		if rc != nil {
+			install.SetRegistryClient(rc)
+		}
+		rel, err = install.Run(chrt, values)
+		if err != nil {
+			installErr := fmt.Errorf("can't install release `%s`: %v", releaseName, err)
+			if opts.Atomic {
+				if uninstallErr := hc.UninstallRelease(releaseName, namespace); uninstallErr != nil {
+					return nil, fmt.Errorf("%v (automatic rollback also failed: %v)", installErr, uninstallErr)
+				}
+			}
+			return nil, installErr
+		}
+		if opts.Wait && !opts.DryRun {
+			if err := hc.waitForRelease(cfg, rel, opts.Timeout); err != nil {
+				if opts.Atomic {
+					if uninstallErr := hc.UninstallRelease(releaseName, namespace); uninstallErr != nil {
+						return nil, fmt.Errorf("%v (automatic rollback also failed: %v)", err, uninstallErr)
+					}
+				}
+				return nil, err
+			}
+		}
+		return rel, nil
+	}
+
+	upgrade := action.NewUpgrade(cfg)
+	upgrade.Namespace = namespace
+	upgrade.Atomic = false
+	upgrade.Wait = false
+	upgrade.Timeout = opts.Timeout
+	upgrade.Force = opts.Force
+	upgrade.ResetValues = opts.ResetValues
+	upgrade.ReuseValues = opts.ReuseValues
+	upgrade.DryRun = opts.DryRun
+	upgrade.MaxHistory = opts.MaxHistory
+	upgrade.CleanupOnFail = opts.CleanupOnFail
+	if rc != nil {
+		upgrade.SetRegistryClient(rc)
+	}
+	rel, err = upgrade.Run(releaseName, chrt, values)
+	if err != nil {
+		upgradeErr := fmt.Errorf("can't upgrade release `%s`: %v", releaseName, err)
+		if opts.Atomic {
+			rollbackOpts := RollbackOptions{Force: opts.Force, Wait: true, Timeout: opts.Timeout, CleanupOnFail: opts.CleanupOnFail}
+			if rollbackErr := hc.RollbackRelease(releaseName, namespace, 0, rollbackOpts); rollbackErr != nil {
+				return nil, fmt.Errorf("%v (automatic rollback also failed: %v)", upgradeErr, rollbackErr)
+			}
+		}
+		return nil, upgradeErr
+	}
+	if opts.Wait && !opts.DryRun {
+		if err := hc.waitForRelease(cfg, rel, opts.Timeout); err != nil {
+			if opts.Atomic {
+				rollbackOpts := RollbackOptions{Force: opts.Force, Wait: true, Timeout: opts.Timeout, CleanupOnFail: opts.CleanupOnFail}
+				if rollbackErr := hc.RollbackRelease(releaseName, namespace, 0, rollbackOpts); rollbackErr != nil {
+					return nil, fmt.Errorf("%v (automatic rollback also failed: %v)", err, rollbackErr)
+				}
+			}
+			return nil, err
+		}
+	}
+	return rel, nil
+}
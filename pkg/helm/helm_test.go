@@ -0,0 +1,341 @@
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	k0sv1beta1 "github.com/k0sproject/k0s/pkg/apis/v1beta1"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func writeTestRepoFile(t *testing.T, dir string, entries ...*repo.Entry) string {
+	t.Helper()
+	f := repo.NewFile()
+	for _, e := range entries {
+		f.Update(e)
+	}
+	repoFile := filepath.Join(dir, "repositories.yaml")
+	if err := f.WriteFile(repoFile, 0644); err != nil {
+		t.Fatalf("can't write test repo file: %v", err)
+	}
+	return repoFile
+}
+
+func TestFindRepoEntry(t *testing.T) {
+	dir := t.TempDir()
+	repoFile := writeTestRepoFile(t, dir,
+		&repo.Entry{Name: "stable", URL: "https://charts.example.com/stable"},
+		&repo.Entry{Name: "other", URL: "https://charts.example.com/other"},
+	)
+	hc := &Commands{repoFile: repoFile}
+
+	tests := []struct {
+		name     string
+		ref      string
+		repoURL  string
+		wantName string
+		wantNil  bool
+	}{
+		{name: "matches by reponame prefix", ref: "stable/mychart", wantName: "stable"},
+		{name: "matches by repo URL when no prefix match", ref: "mychart", repoURL: "https://charts.example.com/other", wantName: "other"},
+		{name: "no match", ref: "unknown/mychart", wantNil: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := hc.findRepoEntry(tt.ref, tt.repoURL)
+			if tt.wantNil {
+				if entry != nil {
+					t.Fatalf("expected no match, got %q", entry.Name)
+				}
+				return
+			}
+			if entry == nil {
+				t.Fatalf("expected match %q, got nil", tt.wantName)
+			}
+			if entry.Name != tt.wantName {
+				t.Fatalf("expected match %q, got %q", tt.wantName, entry.Name)
+			}
+		})
+	}
+}
+
+// TestLocateChartVerifiesUnderRepoURL proves that verification configured
+// for a repository is still enforced when locateChart is given that
+// repository's URL directly (the repoURL parameter), which rewrites name to
+// a resolved chart URL partway through. A repository is considered for
+// verification by its configured name, resolved before that rewrite
+// happens; if the lookup instead used the rewritten chart URL, verification
+// would silently never trigger and this download would succeed even though
+// no provenance file is served.
+func TestLocateChartVerifiesUnderRepoURL(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	indexYAML := fmt.Sprintf(`apiVersion: v1
+entries:
+  mychart:
+  - apiVersion: v2
+    name: mychart
+    version: 0.1.0
+    urls:
+    - %s/mychart-0.1.0.tgz
+generated: "2024-01-01T00:00:00Z"
+`, srv.URL)
+	chartData := newTestChartArchive(t, "mychart", "0.1.0")
+
+	mux.HandleFunc("/index.yaml", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(indexYAML))
+	})
+	mux.HandleFunc("/mychart-0.1.0.tgz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(chartData)
+	})
+	// Deliberately no handler for /mychart-0.1.0.tgz.prov: if verification
+	// is enforced, fetching it will 404 and locateChart must fail.
+
+	dir := t.TempDir()
+	repoFile := writeTestRepoFile(t, dir, &repo.Entry{Name: "myrepo", URL: srv.URL})
+	hc := &Commands{repoFile: repoFile, helmCacheDir: dir}
+	if err := hc.setVerifyConfig("myrepo", repoVerifyConfig{Verify: true}); err != nil {
+		t.Fatalf("can't set verify config: %v", err)
+	}
+
+	if _, err := hc.locateChart("mychart", "0.1.0", srv.URL); err == nil {
+		t.Fatalf("expected locateChart to fail verification since no provenance file was served")
+	}
+}
+
+func TestOCIChartFilename(t *testing.T) {
+	tests := []struct {
+		name           string
+		unversionedRef string
+		version        string
+		want           string
+	}{
+		{name: "versioned", unversionedRef: "registry.example.com/charts/mychart", version: "1.2.3", want: "mychart-1.2.3.tgz"},
+		{name: "no version", unversionedRef: "registry.example.com/charts/mychart", version: "", want: "mychart-.tgz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ociChartFilename(tt.unversionedRef, tt.version); got != tt.want {
+				t.Fatalf("ociChartFilename(%q, %q) = %q, want %q", tt.unversionedRef, tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveRepository(t *testing.T) {
+	t.Run("classic repository", func(t *testing.T) {
+		dir := t.TempDir()
+		repoFile := writeTestRepoFile(t, dir, &repo.Entry{Name: "myrepo", URL: "https://charts.example.com/myrepo"})
+		hc := &Commands{repoFile: repoFile, helmCacheDir: dir}
+
+		indexFile := filepath.Join(dir, "myrepo-index.yaml")
+		chartsFile := filepath.Join(dir, "myrepo-charts.txt")
+		for _, f := range []string{indexFile, chartsFile} {
+			if err := ioutil.WriteFile(f, []byte("test"), 0644); err != nil {
+				t.Fatalf("can't write test cache file: %v", err)
+			}
+		}
+
+		if err := hc.RemoveRepository("myrepo"); err != nil {
+			t.Fatalf("RemoveRepository() error = %v", err)
+		}
+
+		f, err := hc.loadRepoFile()
+		if err != nil {
+			t.Fatalf("can't reload repo file: %v", err)
+		}
+		if f.Has("myrepo") {
+			t.Fatalf("expected myrepo to be removed from repo file")
+		}
+		for _, f := range []string{indexFile, chartsFile} {
+			if _, err := os.Stat(f); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to be removed", f)
+			}
+		}
+	})
+
+	t.Run("oci repository", func(t *testing.T) {
+		dir := t.TempDir()
+		repoFile := writeTestRepoFile(t, dir)
+		hc := &Commands{repoFile: repoFile, helmCacheDir: dir}
+
+		if err := hc.saveOCIRepo("myociRepo", "registry.example.com"); err != nil {
+			t.Fatalf("can't save OCI repo: %v", err)
+		}
+
+		if err := hc.RemoveRepository("myociRepo"); err != nil {
+			t.Fatalf("RemoveRepository() error = %v", err)
+		}
+
+		entries, err := hc.loadOCIRepos()
+		if err != nil {
+			t.Fatalf("can't reload OCI repos: %v", err)
+		}
+		if _, ok := entries["myociRepo"]; ok {
+			t.Fatalf("expected myociRepo to be removed")
+		}
+	})
+
+	t.Run("unknown repository", func(t *testing.T) {
+		dir := t.TempDir()
+		repoFile := writeTestRepoFile(t, dir)
+		hc := &Commands{repoFile: repoFile, helmCacheDir: dir}
+
+		if err := hc.RemoveRepository("unknown"); err == nil {
+			t.Fatalf("expected an error removing an unknown repository")
+		}
+	})
+}
+
+func TestOCIRegistryHost(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "scheme and path", in: "oci://ghcr.io/myorg/charts", want: "ghcr.io"},
+		{name: "no scheme, with path", in: "ghcr.io/myorg/charts/mychart:1.2.3", want: "ghcr.io"},
+		{name: "host only", in: "oci://ghcr.io", want: "ghcr.io"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ociRegistryHost(tt.in); got != tt.want {
+				t.Fatalf("ociRegistryHost(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// chartVerifierFunc adapts a function to the ChartVerifier interface.
+type chartVerifierFunc func(ctx context.Context, ref string, publicKey string) error
+
+func (f chartVerifierFunc) Verify(ctx context.Context, ref string, publicKey string) error {
+	return f(ctx, ref, publicKey)
+}
+
+// newTestChartArchive builds the bytes of a minimal but valid chart tarball,
+// suitable for pushing to an OCI registry.
+func newTestChartArchive(t *testing.T, name, version string) []byte {
+	t.Helper()
+	content := []byte(fmt.Sprintf("apiVersion: v2\nname: %s\nversion: %s\n", name, version))
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: name + "/Chart.yaml", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatalf("can't write chart archive header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("can't write chart archive content: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("can't close chart archive: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("can't close chart archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestOCIVerifyAppliesUnderRepoPath proves that a Verify setting configured
+// for an oci:// repository whose URL has a path component (e.g.
+// oci://host/myorg/charts) still applies when locating a chart under that
+// path, since AddRepository and locateOCIChart must resolve the same
+// registry host from it.
+func TestOCIVerifyAppliesUnderRepoPath(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	hc := &Commands{repoFile: filepath.Join(dir, "repositories.yaml"), helmCacheDir: dir}
+
+	repoCfg := k0sv1beta1.Repository{
+		Name:            "myrepo",
+		URL:             fmt.Sprintf("oci://%s/myorg/charts", host),
+		Verify:          true,
+		CosignPublicKey: "/keys/cosign.pub",
+	}
+	if err := hc.AddRepository(repoCfg); err != nil {
+		t.Fatalf("AddRepository() error = %v", err)
+	}
+
+	rc, err := hc.registryClient()
+	if err != nil {
+		t.Fatalf("can't create registry client: %v", err)
+	}
+	chartRef := fmt.Sprintf("%s/myorg/charts/mychart:0.1.0", host)
+	if _, err := rc.Push(newTestChartArchive(t, "mychart", "0.1.0"), chartRef); err != nil {
+		t.Fatalf("can't push test chart: %v", err)
+	}
+
+	verified := false
+	hc.SetChartVerifier(chartVerifierFunc(func(ctx context.Context, ref string, publicKey string) error {
+		verified = true
+		if publicKey != repoCfg.CosignPublicKey {
+			t.Fatalf("expected public key %q, got %q", repoCfg.CosignPublicKey, publicKey)
+		}
+		return nil
+	}))
+
+	if _, err := hc.locateOCIChart(fmt.Sprintf("oci://%s/myorg/charts/mychart", host), "0.1.0"); err != nil {
+		t.Fatalf("locateOCIChart() error = %v", err)
+	}
+	if !verified {
+		t.Fatalf("expected chart verifier to be invoked for a repository URL with a path component")
+	}
+}
+
+func TestUpdateRepositories(t *testing.T) {
+	index := []byte("apiVersion: v1\nentries: {}\ngenerated: \"2024-01-01T00:00:00Z\"\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(index)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	repoFile := writeTestRepoFile(t, dir,
+		&repo.Entry{Name: "good1", URL: srv.URL},
+		&repo.Entry{Name: "good2", URL: srv.URL},
+		&repo.Entry{Name: "bad", URL: "http://127.0.0.1:0"},
+	)
+	hc := &Commands{repoFile: repoFile, helmCacheDir: t.TempDir()}
+
+	t.Run("selected repositories succeed", func(t *testing.T) {
+		if err := hc.UpdateRepositories("good1", "good2"); err != nil {
+			t.Fatalf("UpdateRepositories() error = %v", err)
+		}
+	})
+
+	t.Run("a failing repository doesn't stop the others and is reported", func(t *testing.T) {
+		for _, name := range []string{"good1", "good2"} {
+			if err := os.Remove(filepath.Join(hc.helmCacheDir, name+"-index.yaml")); err != nil && !os.IsNotExist(err) {
+				t.Fatalf("can't reset cached index of %s: %v", name, err)
+			}
+		}
+		if err := hc.UpdateRepositories(); err == nil {
+			t.Fatalf("expected an aggregated error for the unreachable repository")
+		}
+		for _, name := range []string{"good1", "good2"} {
+			if _, err := os.Stat(filepath.Join(hc.helmCacheDir, name+"-index.yaml")); err != nil {
+				t.Fatalf("expected %s to be refreshed despite the failing repository: %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package helm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// writeTestChart writes a minimal chart directory under dir/name, with an
+// optional broken template that fails to render (referencing a value that
+// does not exist), to deterministically force install.Run/upgrade.Run to
+// fail without needing a real cluster.
+func writeTestChart(t *testing.T, dir, name, version string, broken bool) string {
+	t.Helper()
+	chartDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Join(chartDir, "templates"), 0755); err != nil {
+		t.Fatalf("can't create chart dir: %v", err)
+	}
+	chartYaml := "apiVersion: v2\nname: " + name + "\nversion: " + version + "\n"
+	if err := ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte(chartYaml), 0644); err != nil {
+		t.Fatalf("can't write Chart.yaml: %v", err)
+	}
+	if broken {
+		tmpl := "{{ .Values.missing.nested }}\n"
+		if err := ioutil.WriteFile(filepath.Join(chartDir, "templates", "broken.yaml"), []byte(tmpl), 0644); err != nil {
+			t.Fatalf("can't write broken template: %v", err)
+		}
+	}
+	return chartDir
+}
+
+func TestInstallOrUpgradeAtomicInstallFailure(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := writeTestChart(t, dir, "mychart", "0.1.0", true)
+
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	hc := &Commands{helmCacheDir: t.TempDir()}
+	withFakeActionCfg(hc, cfg)
+
+	_, err := hc.InstallOrUpgrade(chartDir, "0.1.0", "myrelease", "default", nil, UpgradeOptions{Atomic: true})
+	if err == nil {
+		t.Fatal("expected install to fail")
+	}
+	if !strings.Contains(err.Error(), "can't install release") {
+		t.Fatalf("expected install error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "automatic rollback also failed") {
+		t.Fatalf("expected atomic install failure to also attempt (and report) a rollback, got: %v", err)
+	}
+}
+
+func TestInstallOrUpgradeNonAtomicInstallFailure(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := writeTestChart(t, dir, "mychart", "0.1.0", true)
+
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	hc := &Commands{helmCacheDir: t.TempDir()}
+	withFakeActionCfg(hc, cfg)
+
+	_, err := hc.InstallOrUpgrade(chartDir, "0.1.0", "myrelease", "default", nil, UpgradeOptions{Atomic: false})
+	if err == nil {
+		t.Fatal("expected install to fail")
+	}
+	if strings.Contains(err.Error(), "automatic rollback") {
+		t.Fatalf("non-atomic install failure must not attempt a rollback, got: %v", err)
+	}
+}
+
+func TestInstallOrUpgradeAtomicUpgradeFailure(t *testing.T) {
+	dir := t.TempDir()
+	chartDir := writeTestChart(t, dir, "mychart", "0.2.0", true)
+
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	if err := cfg.Releases.Create(mockRelease("myrelease", 1, release.StatusDeployed)); err != nil {
+		t.Fatalf("can't seed existing release: %v", err)
+	}
+	hc := &Commands{helmCacheDir: t.TempDir()}
+	withFakeActionCfg(hc, cfg)
+
+	_, err := hc.InstallOrUpgrade(chartDir, "0.2.0", "myrelease", "default", nil, UpgradeOptions{Atomic: true})
+	if err == nil {
+		t.Fatal("expected upgrade to fail")
+	}
+	if !strings.Contains(err.Error(), "can't upgrade release") {
+		t.Fatalf("expected upgrade error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "automatic rollback") {
+		t.Fatalf("expected atomic upgrade failure to also attempt (and report) a rollback, got: %v", err)
+	}
+}
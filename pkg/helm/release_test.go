@@ -0,0 +1,157 @@
+package helm
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+var chartStub = chart.Chart{Metadata: &chart.Metadata{Name: "mychart", Version: "0.1.0", APIVersion: "v2"}}
+
+// newTestActionConfig builds an in-memory action.Configuration backed by a
+// fake kube client, so release lifecycle operations can be exercised without
+// a real cluster.
+func newTestActionConfig(t *testing.T, kc *kubefake.FailingKubeClient) *action.Configuration {
+	t.Helper()
+	return &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   kc,
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(format string, v ...interface{}) {},
+	}
+}
+
+func mockRelease(name string, version int, status release.Status) *release.Release {
+	return &release.Release{
+		Name:      name,
+		Namespace: "default",
+		Version:   version,
+		Info:      &release.Info{Status: status},
+		Chart:     &chartStub,
+		Config:    map[string]interface{}{"foo": "bar"},
+	}
+}
+
+func withFakeActionCfg(hc *Commands, cfg *action.Configuration) {
+	hc.actionCfgFactory = func(namespace string) (*action.Configuration, error) {
+		return cfg, nil
+	}
+}
+
+func TestRollbackRelease(t *testing.T) {
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	if err := cfg.Releases.Create(mockRelease("myrelease", 1, release.StatusSuperseded)); err != nil {
+		t.Fatalf("can't seed revision 1: %v", err)
+	}
+	if err := cfg.Releases.Create(mockRelease("myrelease", 2, release.StatusDeployed)); err != nil {
+		t.Fatalf("can't seed revision 2: %v", err)
+	}
+
+	hc := &Commands{}
+	withFakeActionCfg(hc, cfg)
+
+	if err := hc.RollbackRelease("myrelease", "default", 0, RollbackOptions{}); err != nil {
+		t.Fatalf("RollbackRelease() error = %v", err)
+	}
+
+	rel, err := cfg.Releases.Last("myrelease")
+	if err != nil {
+		t.Fatalf("can't load rolled back release: %v", err)
+	}
+	if rel.Version != 3 {
+		t.Fatalf("expected rollback to create revision 3, got %d", rel.Version)
+	}
+}
+
+func TestReleaseHistory(t *testing.T) {
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	if err := cfg.Releases.Create(mockRelease("myrelease", 1, release.StatusSuperseded)); err != nil {
+		t.Fatalf("can't seed revision 1: %v", err)
+	}
+	if err := cfg.Releases.Create(mockRelease("myrelease", 2, release.StatusDeployed)); err != nil {
+		t.Fatalf("can't seed revision 2: %v", err)
+	}
+
+	hc := &Commands{}
+	withFakeActionCfg(hc, cfg)
+
+	releases, err := hc.ReleaseHistory("myrelease", "default", 0)
+	if err != nil {
+		t.Fatalf("ReleaseHistory() error = %v", err)
+	}
+	if len(releases) != 2 {
+		t.Fatalf("expected 2 revisions, got %d", len(releases))
+	}
+
+	if _, err := hc.ReleaseHistory("unknown", "default", 0); err == nil {
+		t.Fatal("expected error for unknown release")
+	}
+}
+
+func TestGetReleaseValues(t *testing.T) {
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	if err := cfg.Releases.Create(mockRelease("myrelease", 1, release.StatusDeployed)); err != nil {
+		t.Fatalf("can't seed release: %v", err)
+	}
+
+	hc := &Commands{}
+	withFakeActionCfg(hc, cfg)
+
+	values, err := hc.GetReleaseValues("myrelease", "default", false)
+	if err != nil {
+		t.Fatalf("GetReleaseValues() error = %v", err)
+	}
+	if values["foo"] != "bar" {
+		t.Fatalf("expected values to contain foo=bar, got %v", values)
+	}
+}
+
+func TestReleaseStatus(t *testing.T) {
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	if err := cfg.Releases.Create(mockRelease("myrelease", 1, release.StatusDeployed)); err != nil {
+		t.Fatalf("can't seed release: %v", err)
+	}
+
+	hc := &Commands{}
+	withFakeActionCfg(hc, cfg)
+
+	rel, err := hc.ReleaseStatus("myrelease", "default")
+	if err != nil {
+		t.Fatalf("ReleaseStatus() error = %v", err)
+	}
+	if rel.Info.Status != release.StatusDeployed {
+		t.Fatalf("expected status %q, got %q", release.StatusDeployed, rel.Info.Status)
+	}
+
+	if _, err := hc.ReleaseStatus("unknown", "default"); err == nil {
+		t.Fatal("expected error for unknown release")
+	}
+}
+
+func TestTestRelease(t *testing.T) {
+	cfg := newTestActionConfig(t, &kubefake.FailingKubeClient{PrintingKubeClient: kubefake.PrintingKubeClient{Out: ioutil.Discard}})
+	if err := cfg.Releases.Create(mockRelease("myrelease", 1, release.StatusDeployed)); err != nil {
+		t.Fatalf("can't seed release: %v", err)
+	}
+
+	hc := &Commands{}
+	withFakeActionCfg(hc, cfg)
+
+	// The seeded chart has no test hooks, so running the tests is a no-op
+	// that should succeed rather than error out.
+	if _, err := hc.TestRelease("myrelease", "default", time.Second); err != nil {
+		t.Fatalf("TestRelease() error = %v", err)
+	}
+
+	if _, err := hc.TestRelease("unknown", "default", time.Second); err == nil {
+		t.Fatal("expected error for unknown release")
+	}
+}